@@ -0,0 +1,41 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !confluent
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/pingcap/tiflow/cdc/model"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"github.com/pingcap/tiflow/pkg/sink/kafka"
+)
+
+// newConfluentKafkaProducer is the default-build stand-in for the confluent-kafka-go
+// backend: linking librdkafka requires cgo and the confluent-kafka-go module, which we
+// don't want to force on every TiCDC build, so that backend only compiles in under the
+// `confluent` build tag (see confluent_producer.go). Without the tag, selecting
+// `backend=confluent` fails fast here instead of leaving `backend=confluent` silently
+// unavailable with an undefined-symbol compile error.
+func newConfluentKafkaProducer(
+	_ context.Context,
+	_ kafka.ClusterAdminClient,
+	_ *kafka.Options,
+	_ chan error,
+	_ model.ChangeFeedID,
+) (Producer, error) {
+	return nil, cerror.ErrKafkaInvalidConfig.GenWithStack(
+		"kafka producer backend %q requires building with `-tags confluent`", kafka.BackendConfluent)
+}
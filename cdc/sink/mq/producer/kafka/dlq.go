@@ -0,0 +1,229 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pingcap/log"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// dlqTopicSuffix is appended to a message's original topic to derive its
+	// dead-letter topic when `Options.DeadLetterTopic` is not configured.
+	dlqTopicSuffix = ".DLQ"
+
+	// dlqOriginalTopicHeaderKey marks a message as already having been routed to its
+	// dead-letter topic once, so a second terminal failure (the dead-letter publish
+	// itself failing) is recognised instead of compounding the suffix into
+	// `foo.DLQ.DLQ`.
+	dlqOriginalTopicHeaderKey = "x-original-topic"
+
+	// retryBaseBackoff and retryMaxBackoff bound the exponential backoff applied
+	// between re-enqueues of a retriable message.
+	retryBaseBackoff = 200 * time.Millisecond
+	retryMaxBackoff  = 30 * time.Second
+
+	// defaultMaxRetries is used when `Options.MaxRetries` is unset (<= 0), so a
+	// transient error gets a few chances to clear before falling back to the
+	// dead-letter topic, instead of every transient error skipping retry entirely.
+	defaultMaxRetries = 3
+)
+
+// retryMetadata is stashed on sarama.ProducerMessage.Metadata so a re-enqueued
+// message remembers how many times it has already been retried.
+type retryMetadata struct {
+	attempts int
+}
+
+// isRetriableKafkaError reports whether err is transient and worth retrying, as
+// opposed to a terminal error that will never succeed no matter how many times the
+// message is resent.
+func isRetriableKafkaError(err error) bool {
+	switch err {
+	case sarama.ErrNotEnoughReplicas,
+		sarama.ErrNotEnoughReplicasAfterAppend,
+		sarama.ErrLeaderNotAvailable,
+		sarama.ErrNotLeaderForPartition,
+		sarama.ErrRequestTimedOut,
+		sarama.ErrBrokerNotAvailable,
+		sarama.ErrOutOfBrokers,
+		sarama.ErrControllerNotAvailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDeadLetterMessage reports whether msg has already been routed to its dead-letter
+// topic once, identified by the presence of dlqOriginalTopicHeaderKey.
+func isDeadLetterMessage(msg *sarama.ProducerMessage) bool {
+	for _, h := range msg.Headers {
+		if string(h.Key) == dlqOriginalTopicHeaderKey {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRetries returns `Options.MaxRetries`, falling back to defaultMaxRetries when it is
+// unset (<= 0).
+func (k *kafkaSaramaProducer) maxRetries() int {
+	if k.options.MaxRetries > 0 {
+		return k.options.MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+// handleProducerError is invoked from `run` for every error sarama surfaces on a
+// produced message. Retriable errors are re-enqueued with exponential backoff up to
+// maxRetries; everything else (including a retriable error that has exhausted its
+// retries) is routed to the message's dead-letter topic. A message that is itself a
+// dead-letter publish is never re-routed: retrying it would just re-derive
+// `foo.DLQ.DLQ`, `foo.DLQ.DLQ.DLQ`, ... towards an ever-growing chain of topics that
+// never resolves, so it is dropped and reported as an error instead, which `run`
+// returns.
+func (k *kafkaSaramaProducer) handleProducerError(ctx context.Context, perr *sarama.ProducerError) error {
+	msg := perr.Msg
+
+	if isDeadLetterMessage(msg) {
+		log.Error("dead-letter publish itself failed, dropping message",
+			zap.String("namespace", k.id.Namespace), zap.String("changefeed", k.id.ID),
+			zap.String("dead-letter-topic", msg.Topic), zap.Error(perr.Err))
+		// The original message's submission was already counted against k.submitted,
+		// and nothing else will ever ack on its behalf now that its dead-letter publish
+		// has also failed terminally. Advance k.acked here so the dropped message still
+		// resolves its slot in the submitted/acked cursor Flush waits on, instead of
+		// leaving Flush blocked until ctx cancellation over a message that is never
+		// coming back.
+		atomic.AddInt64(&k.acked, 1)
+		k.wakeFlushWaiters()
+		return cerror.WrapError(cerror.ErrKafkaSendMessage, perr.Err)
+	}
+
+	meta, _ := msg.Metadata.(*retryMetadata)
+	if meta == nil {
+		meta = &retryMetadata{}
+	}
+
+	if isRetriableKafkaError(perr.Err) && meta.attempts < k.maxRetries() {
+		meta.attempts++
+		msg.Metadata = meta
+		backoff := retryBackoff(meta.attempts)
+		log.Warn("retrying kafka message after a retriable producer error",
+			zap.String("namespace", k.id.Namespace), zap.String("changefeed", k.id.ID),
+			zap.String("topic", msg.Topic), zap.Int32("partition", msg.Partition),
+			zap.Int("attempt", meta.attempts), zap.Duration("backoff", backoff), zap.Error(perr.Err))
+		go k.retryAfter(ctx, backoff, msg)
+		return nil
+	}
+
+	// sendToDeadLetter runs in its own goroutine rather than being awaited here:
+	// `run` is also the sole drainer of asyncProducer.Errors()/Successes(), so
+	// blocking it on enqueuing the dead-letter message risked a deadlock against
+	// sarama trying to hand it the next error. Any failure to complete the publish
+	// comes back on dlqErrCh instead.
+	go k.sendToDeadLetter(ctx, msg, perr.Err)
+	return nil
+}
+
+// retryBackoff returns an exponential backoff for the given 1-indexed attempt number,
+// capped at retryMaxBackoff.
+func retryBackoff(attempt int) time.Duration {
+	backoff := retryBaseBackoff << (attempt - 1)
+	if backoff > retryMaxBackoff || backoff <= 0 {
+		return retryMaxBackoff
+	}
+	return backoff
+}
+
+// retryAfter re-enqueues msg onto its partition's submission queue once backoff has
+// elapsed, unless the producer is closed or ctx is cancelled first.
+func (k *kafkaSaramaProducer) retryAfter(ctx context.Context, backoff time.Duration, msg *sarama.ProducerMessage) {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-k.closeCh:
+		return
+	case <-timer.C:
+	}
+
+	queue := k.partitionQueue(msg.Partition)
+	select {
+	case <-ctx.Done():
+	case <-k.closeCh:
+	case queue <- msg:
+	}
+}
+
+// sendToDeadLetter routes a permanently failed message to its dead-letter topic,
+// tagged with headers describing where it came from and why it failed. It is always
+// called via `go` from handleProducerError and enqueues through the partition
+// dispatcher, the same way retryAfter does, rather than writing asyncProducer.Input()
+// directly from the ack loop. Any failure to complete the publish is reported on
+// dlqErrCh rather than returned, since the caller has already moved on.
+func (k *kafkaSaramaProducer) sendToDeadLetter(ctx context.Context, msg *sarama.ProducerMessage, cause error) {
+	dlqTopic := k.options.DeadLetterTopic
+	if dlqTopic == "" {
+		dlqTopic = msg.Topic + dlqTopicSuffix
+	}
+
+	dlqMsg := &sarama.ProducerMessage{
+		Topic:     dlqTopic,
+		Partition: msg.Partition,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers: []sarama.RecordHeader{
+			{Key: []byte(dlqOriginalTopicHeaderKey), Value: []byte(msg.Topic)},
+			{Key: []byte("x-original-partition"), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+			{Key: []byte("x-changefeed-id"), Value: []byte(k.id.ID)},
+			{Key: []byte("x-failure-reason"), Value: []byte(cause.Error())},
+		},
+	}
+
+	queue := k.partitionQueue(dlqMsg.Partition)
+	select {
+	case <-ctx.Done():
+		k.reportDeadLetterError(cerror.WrapError(cerror.ErrKafkaSendMessage, ctx.Err()))
+		return
+	case <-k.closeCh:
+		return
+	case queue <- dlqMsg:
+	}
+
+	log.Warn("routed permanently failed message to its dead-letter topic",
+		zap.String("namespace", k.id.Namespace), zap.String("changefeed", k.id.ID),
+		zap.String("topic", msg.Topic), zap.Int32("partition", msg.Partition),
+		zap.String("dead-letter-topic", dlqTopic), zap.Error(cause))
+}
+
+// reportDeadLetterError forwards a dead-letter publish failure to `run` without
+// blocking. `run` tears the changefeed down on the first error it observes on
+// dlqErrCh, so dropping one here only happens when `run` has already exited for some
+// other reason.
+func (k *kafkaSaramaProducer) reportDeadLetterError(err error) {
+	select {
+	case k.dlqErrCh <- err:
+	case <-k.closeCh:
+	default:
+	}
+}
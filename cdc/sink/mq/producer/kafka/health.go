@@ -0,0 +1,161 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tiflow/cdc/sink/codec/common"
+	"go.uber.org/zap"
+)
+
+// defaultLivenessSilenceWindow is how long `run` may go without acking a message, or
+// SendLiveness producing a heartbeat, before the liveness channel is told `false`, used
+// when `options.LivenessSilenceWindow` is unset.
+const defaultLivenessSilenceWindow = 30 * time.Second
+
+// kafkaProducerHealth holds the state backing EnableLivenessChannel and EnableHealthinessChannel.
+// Both channels use latest-value semantics: sends are non-blocking and drop the
+// previous pending value rather than block the producer's hot paths.
+type kafkaProducerHealth struct {
+	livenessOnce sync.Once
+	livenessCh   chan bool
+	lastAckNano  int64 // atomic, unix nanoseconds
+
+	healthinessOnce sync.Once
+	healthinessCh   chan bool
+}
+
+// EnableLivenessChannel returns a channel that receives `true` whenever a message is
+// acked (or a liveness heartbeat is sent via SendLiveness), and `false` once the
+// producer's liveness silence window (`options.LivenessSilenceWindow`, or
+// defaultLivenessSilenceWindow when unset) has elapsed without either. Passing
+// enable=false stops further updates; the channel itself is still returned so callers
+// can drain it.
+func (k *kafkaSaramaProducer) EnableLivenessChannel(enable bool) <-chan bool {
+	k.health.livenessOnce.Do(func() {
+		k.health.livenessCh = make(chan bool, 1)
+		atomic.StoreInt64(&k.health.lastAckNano, time.Now().UnixNano())
+		go k.watchLiveness()
+	})
+	if enable {
+		atomic.StoreInt32(&k.livenessEnabled, 1)
+	} else {
+		atomic.StoreInt32(&k.livenessEnabled, 0)
+	}
+	return k.health.livenessCh
+}
+
+// EnableHealthinessChannel returns a channel that receives `false` when an
+// unrecoverable error is observed on the sarama async producer's error stream, and
+// `true` otherwise. Passing enable=false stops further updates.
+func (k *kafkaSaramaProducer) EnableHealthinessChannel(enable bool) <-chan bool {
+	k.health.healthinessOnce.Do(func() {
+		k.health.healthinessCh = make(chan bool, 1)
+	})
+	if enable {
+		atomic.StoreInt32(&k.healthinessEnabled, 1)
+	} else {
+		atomic.StoreInt32(&k.healthinessEnabled, 0)
+	}
+	return k.health.healthinessCh
+}
+
+// SendLiveness produces a heartbeat message to topic and marks the producer live on
+// success, for callers that want a liveness signal even when no changefeed traffic is
+// flowing through AsyncSendMessage.
+func (k *kafkaSaramaProducer) SendLiveness(ctx context.Context, topic string) error {
+	err := k.AsyncSendMessage(ctx, topic, 0, &common.Message{Key: nil, Value: []byte("liveness")})
+	if err != nil {
+		return err
+	}
+	k.setLiveness(true)
+	return nil
+}
+
+func (k *kafkaSaramaProducer) setLiveness(live bool) {
+	if atomic.LoadInt32(&k.livenessEnabled) == 0 {
+		return
+	}
+	if live {
+		atomic.StoreInt64(&k.health.lastAckNano, time.Now().UnixNano())
+	}
+	nonBlockingSend(k.health.livenessCh, live)
+}
+
+func (k *kafkaSaramaProducer) setHealthiness(healthy bool) {
+	if atomic.LoadInt32(&k.healthinessEnabled) == 0 {
+		return
+	}
+	nonBlockingSend(k.health.healthinessCh, healthy)
+}
+
+// livenessSilenceWindow returns options.LivenessSilenceWindow when the producer was
+// configured with one, falling back to defaultLivenessSilenceWindow otherwise.
+func (k *kafkaSaramaProducer) livenessSilenceWindow() time.Duration {
+	if k.options != nil && k.options.LivenessSilenceWindow > 0 {
+		return k.options.LivenessSilenceWindow
+	}
+	return defaultLivenessSilenceWindow
+}
+
+// watchLiveness periodically checks whether longer than the producer's liveness silence
+// window has passed since the last ack (or heartbeat), and if so reports liveness as
+// false.
+func (k *kafkaSaramaProducer) watchLiveness() {
+	window := k.livenessSilenceWindow()
+	ticker := time.NewTicker(window / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.closeCh:
+			return
+		case <-ticker.C:
+			if atomic.LoadInt32(&k.livenessEnabled) == 0 {
+				continue
+			}
+			last := atomic.LoadInt64(&k.health.lastAckNano)
+			if time.Since(time.Unix(0, last)) > window {
+				log.Warn("kafka producer liveness silence window exceeded",
+					zap.String("namespace", k.id.Namespace),
+					zap.String("changefeed", k.id.ID),
+					zap.Duration("silence", time.Since(time.Unix(0, last))))
+				nonBlockingSend(k.health.livenessCh, false)
+			}
+		}
+	}
+}
+
+// nonBlockingSend delivers the latest value on ch, dropping a stale pending value
+// rather than blocking the caller.
+func nonBlockingSend(ch chan bool, value bool) {
+	if ch == nil {
+		return
+	}
+	for {
+		select {
+		case ch <- value:
+			return
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+		}
+	}
+}
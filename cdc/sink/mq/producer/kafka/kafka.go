@@ -58,30 +58,133 @@ type kafkaSaramaProducer struct {
 	// producersReleased records whether asyncProducer and syncProducer have been closed properly
 	producersReleased bool
 
-	// It is used to count the number of messages sent out and messages received when flushing data.
-	mu struct {
+	// submitted is a monotonic count of messages handed to AsyncSendMessage, and acked
+	// is a monotonic count of messages observed back from the ack loop in `run`. Both are
+	// only ever advanced with atomic adds, so many goroutines may call AsyncSendMessage
+	// concurrently: Flush simply snapshots `submitted` and waits for `acked` to catch up,
+	// with no requirement that callers serialize among themselves.
+	submitted int64
+	acked     int64
+
+	// flush coordinates wake-ups for Flush callers blocked on `acked` catching up to
+	// the `submitted` count observed at the time they were called.
+	flush struct {
 		sync.Mutex
-		inflight  int64
-		flushDone chan struct{}
+		waiters []chan struct{}
 	}
 
+	// partitionsMu guards partitions, the per-partition submission queues. A dedicated
+	// dispatcher goroutine owns each queue and is the only goroutine that ever writes to
+	// asyncProducer.Input(), so callers enqueuing from multiple goroutines never contend
+	// on the shared sarama input channel directly.
+	partitionsMu sync.Mutex
+	partitions   map[int32]chan *sarama.ProducerMessage
+
 	failpointCh chan error
 
+	// dlqErrCh carries a failure to complete a dead-letter publish back to `run`.
+	// sendToDeadLetter runs in its own goroutine rather than blocking `run` directly
+	// (see sendToDeadLetter's doc comment), so this is how it reports back.
+	dlqErrCh chan error
+
 	closeCh chan struct{}
 	// atomic flag indicating whether the producer is closing
 	closing kafkaProducerClosingFlag
 
+	// health backs EnableLivenessChannel/EnableHealthinessChannel; livenessEnabled and
+	// healthinessEnabled are atomic bools gating whether updates are actually sent.
+	health             kafkaProducerHealth
+	livenessEnabled    int32
+	healthinessEnabled int32
+
+	// eosEnabled records whether the producer was built with `EnableExactlyOnce`, in
+	// which case Flush commits the open Kafka transaction instead of merely awaiting
+	// acks, and each resolved-ts window is emitted as a single atomic transaction.
+	eosEnabled bool
+	txn        struct {
+		sync.Mutex
+		open       bool
+		resolvedTs model.Ts
+	}
+
+	// options is retained so `run` can consult `MaxRetries` and `DeadLetterTopic` when
+	// classifying a produced message's failure.
+	options *kafka.Options
+
+	// runCtx is the producer's own long-lived context, the one passed to
+	// NewKafkaSaramaProducer/run. Partition dispatcher goroutines are bound to it,
+	// never to the context of whichever AsyncSendMessage call happens to create a
+	// partition's queue first: a per-send ctx is cancelled once that one call
+	// returns, which would otherwise kill the dispatcher while the queue is still
+	// cached and handed out to later callers.
+	runCtx context.Context
+
 	role util.Role
 	id   model.ChangeFeedID
 }
 
+// transactionalProducer is implemented by sarama async producers configured with
+// `Producer.Idempotent=true`. It is narrowed from kafka.AsyncProducer via a type
+// assertion so EOS support stays optional without widening that interface.
+type transactionalProducer interface {
+	BeginTxn() error
+	CommitTxn() error
+	AbortTxn() error
+}
+
 type kafkaProducerClosingFlag = int32
 
+// partitionQueueSize is the buffer depth of each per-partition submission queue sitting
+// in front of the shared sarama input channel.
+const partitionQueueSize = 256
+
+// partitionQueue returns the submission queue dedicated to `partition`, creating it and
+// its dispatcher goroutine on first use. The dispatcher always runs for the lifetime of
+// the producer (k.runCtx/k.closeCh), regardless of which caller's ctx triggered its
+// creation.
+func (k *kafkaSaramaProducer) partitionQueue(partition int32) chan *sarama.ProducerMessage {
+	k.partitionsMu.Lock()
+	defer k.partitionsMu.Unlock()
+
+	queue, ok := k.partitions[partition]
+	if ok {
+		return queue
+	}
+	queue = make(chan *sarama.ProducerMessage, partitionQueueSize)
+	k.partitions[partition] = queue
+	go k.dispatchPartition(k.runCtx, partition, queue)
+	return queue
+}
+
+// dispatchPartition is the single writer of asyncProducer.Input() for `partition`. It
+// decouples callers of AsyncSendMessage from the shared sarama input channel, so that
+// enqueuing from one partition can never be held up by another.
+func (k *kafkaSaramaProducer) dispatchPartition(
+	ctx context.Context, partition int32, queue chan *sarama.ProducerMessage,
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-k.closeCh:
+			return
+		case msg := <-queue:
+			select {
+			case <-ctx.Done():
+				return
+			case <-k.closeCh:
+				return
+			case k.asyncProducer.Input() <- msg:
+			}
+		}
+	}
+}
+
 // AsyncSendMessage asynchronously sends a message to kafka.
-// Notice: this method is not thread-safe.
-// Do not try to call AsyncSendMessage and Flush functions in different threads,
-// otherwise Flush will not work as expected. It may never finish or flush the wrong message.
-// Because inflight will be modified by mistake.
+// It is safe to call AsyncSendMessage from multiple goroutines concurrently, including
+// concurrently with Flush: each message is assigned a monotonic sequence number before
+// it is handed to its partition's dispatcher, and Flush waits for the acked cursor to
+// reach the submitted cursor observed at the time it was called.
 func (k *kafkaSaramaProducer) AsyncSendMessage(
 	ctx context.Context, topic string, partition int32, message *common.Message,
 ) error {
@@ -94,6 +197,14 @@ func (k *kafkaSaramaProducer) AsyncSendMessage(
 		return nil
 	}
 
+	// When EOS is enabled, every message must land inside an open Kafka transaction.
+	// Callers that track resolved-ts windows should call BeginTxn explicitly before
+	// emitting a window's messages; this lazily opens one on their behalf otherwise,
+	// so Flush's CommitTxn always has something to commit.
+	if err := k.ensureTxnOpen(); err != nil {
+		return err
+	}
+
 	failpoint.Inject("KafkaSinkAsyncSendError", func() {
 		// simulate sending message to input channel successfully but flushing
 		// message to Kafka meets error
@@ -109,17 +220,16 @@ func (k *kafkaSaramaProducer) AsyncSendMessage(
 		Value:     sarama.ByteEncoder(message.Value),
 		Partition: partition,
 	}
-	k.mu.Lock()
-	k.mu.inflight++
-	log.Debug("emitting inflight messages to kafka", zap.Int64("inflight", k.mu.inflight))
-	k.mu.Unlock()
+	seq := atomic.AddInt64(&k.submitted, 1)
+	log.Debug("emitting inflight messages to kafka", zap.Int64("submitted", seq))
 
+	queue := k.partitionQueue(partition)
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-k.closeCh:
 		return nil
-	case k.asyncProducer.Input() <- msg:
+	case queue <- msg:
 	}
 	return nil
 }
@@ -140,53 +250,221 @@ func (k *kafkaSaramaProducer) SyncBroadcastMessage(
 	}
 }
 
-// Flush waits for all the messages in the async producer to be sent to Kafka.
-// Notice: this method is not thread-safe.
-// Do not try to call AsyncSendMessage and Flush functions in different threads,
-// otherwise Flush will not work as expected. It may never finish or flush the wrong message.
-// Because inflight will be modified by mistake.
+// Flush waits for all the messages submitted before this call to be acked by Kafka.
+// It is safe to call Flush concurrently with AsyncSendMessage, including from
+// multiple goroutines submitting to different partitions: Flush only waits for the
+// acked cursor to reach the submitted cursor it observed when it was called, so
+// messages submitted after Flush was entered do not hold it up.
+// When the producer was built with `EnableExactlyOnce`, Flush additionally commits the
+// open Kafka transaction once every message has been acked, so that the whole
+// resolved-ts window lands atomically for `read_committed` consumers.
 func (k *kafkaSaramaProducer) Flush(ctx context.Context) error {
-	done := make(chan struct{}, 1)
+	if err := k.awaitAcked(ctx); err != nil {
+		return err
+	}
+	if k.eosEnabled {
+		return k.CommitTxn()
+	}
+	return nil
+}
+
+// awaitAcked blocks until every message submitted before this call has been acked.
+func (k *kafkaSaramaProducer) awaitAcked(ctx context.Context) error {
+	target := atomic.LoadInt64(&k.submitted)
+	for atomic.LoadInt64(&k.acked) < target {
+		waitCh := make(chan struct{})
+		// The waiter must be registered before re-checking the cursor, and both must
+		// happen under the same hold of flush.Lock as wakeFlushWaiters's own
+		// lock/unlock: otherwise the final ack could land, and wakeFlushWaiters run
+		// against an as-yet-empty waiter list, in the gap between this goroutine's
+		// (now stale) check on the loop condition above and its registration below,
+		// leaving waitCh registered too late to ever be closed.
+		k.flush.Lock()
+		k.flush.waiters = append(k.flush.waiters, waitCh)
+		acked := atomic.LoadInt64(&k.acked)
+		k.flush.Unlock()
+		if acked >= target {
+			return nil
+		}
+
+		log.Debug("flush waiting for inflight messages",
+			zap.Int64("submitted", target), zap.Int64("acked", acked))
+		select {
+		case <-k.closeCh:
+			return cerror.ErrKafkaFlushUnfinished.GenWithStackByArgs()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-waitCh:
+		}
+	}
+	return nil
+}
+
+// txnProducer narrows asyncProducer to the optional transactional API, only present
+// when the producer was created with `Producer.Idempotent=true`.
+func (k *kafkaSaramaProducer) txnProducer() (transactionalProducer, bool) {
+	txnProducer, ok := k.asyncProducer.(transactionalProducer)
+	return txnProducer, ok
+}
 
-	k.mu.Lock()
-	inflight := k.mu.inflight
-	immediateFlush := inflight == 0
-	if !immediateFlush {
-		k.mu.flushDone = done
+// ensureTxnOpen opens a transaction keyed on the current submitted cursor if EOS is
+// enabled and none is already open. It is a no-op otherwise. Unlike an explicit
+// BeginTxn call, finding a transaction already open here is treated as success rather
+// than a nested-window error: many goroutines may race into ensureTxnOpen concurrently
+// via AsyncSendMessage (that concurrency is the point of the chunk0-1 redesign), so the
+// check and the open are done under a single hold of `txn.Lock` and whichever caller
+// loses the race just observes the transaction the winner opened.
+func (k *kafkaSaramaProducer) ensureTxnOpen() error {
+	if !k.eosEnabled {
+		return nil
+	}
+	txnProducer, ok := k.txnProducer()
+	if !ok {
+		return cerror.ErrKafkaInvalidConfig.GenWithStack(
+			"exactly-once is enabled but the underlying producer does not support transactions")
 	}
-	k.mu.Unlock()
 
-	if immediateFlush {
+	k.txn.Lock()
+	defer k.txn.Unlock()
+	if k.txn.open {
 		return nil
 	}
+	if err := txnProducer.BeginTxn(); err != nil {
+		return cerror.WrapError(cerror.ErrKafkaNewSaramaProducer, err)
+	}
+	k.txn.open = true
+	k.txn.resolvedTs = model.Ts(atomic.LoadInt64(&k.submitted))
+	return nil
+}
 
-	log.Debug("flush waiting for inflight messages", zap.Int64("inflight", inflight))
-	select {
-	case <-k.closeCh:
-		return cerror.ErrKafkaFlushUnfinished.GenWithStackByArgs()
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-done:
+// BeginTxn opens a new Kafka transaction for the resolved-ts window starting at
+// resolvedTs. It must be called before any AsyncSendMessage belonging to that window.
+func (k *kafkaSaramaProducer) BeginTxn(resolvedTs model.Ts) error {
+	if !k.eosEnabled {
 		return nil
 	}
+	txnProducer, ok := k.txnProducer()
+	if !ok {
+		return cerror.ErrKafkaInvalidConfig.GenWithStack(
+			"exactly-once is enabled but the underlying producer does not support transactions")
+	}
+
+	k.txn.Lock()
+	defer k.txn.Unlock()
+	if k.txn.open {
+		return cerror.ErrKafkaInvalidConfig.GenWithStack(
+			"BeginTxn called while a transaction for resolved-ts %d is still open", k.txn.resolvedTs)
+	}
+	if err := txnProducer.BeginTxn(); err != nil {
+		return cerror.WrapError(cerror.ErrKafkaNewSaramaProducer, err)
+	}
+	k.txn.open = true
+	k.txn.resolvedTs = resolvedTs
+	return nil
+}
+
+// CommitTxn commits the currently open transaction, if any. It is a no-op when EOS
+// is disabled or no transaction is open, so Flush can call it unconditionally.
+func (k *kafkaSaramaProducer) CommitTxn() error {
+	if !k.eosEnabled {
+		return nil
+	}
+	txnProducer, ok := k.txnProducer()
+	if !ok {
+		return nil
+	}
+
+	k.txn.Lock()
+	defer k.txn.Unlock()
+	if !k.txn.open {
+		return nil
+	}
+	if err := txnProducer.CommitTxn(); err != nil {
+		return cerror.WrapError(cerror.ErrKafkaNewSaramaProducer, err)
+	}
+	k.txn.open = false
+	return nil
+}
+
+// AbortTxn aborts the currently open transaction, if any, discarding every message
+// produced within it. Callers use this on changefeed teardown so that a half-written
+// resolved-ts window never becomes visible to `read_committed` consumers.
+func (k *kafkaSaramaProducer) AbortTxn() error {
+	if !k.eosEnabled {
+		return nil
+	}
+	txnProducer, ok := k.txnProducer()
+	if !ok {
+		return nil
+	}
+
+	k.txn.Lock()
+	defer k.txn.Unlock()
+	if !k.txn.open {
+		return nil
+	}
+	if err := txnProducer.AbortTxn(); err != nil {
+		return cerror.WrapError(cerror.ErrKafkaNewSaramaProducer, err)
+	}
+	k.txn.open = false
+	return nil
+}
+
+// wakeFlushWaiters notifies every Flush call currently blocked so that each can
+// re-check whether the acked cursor has reached its own target.
+func (k *kafkaSaramaProducer) wakeFlushWaiters() {
+	k.flush.Lock()
+	waiters := k.flush.waiters
+	k.flush.waiters = nil
+	k.flush.Unlock()
+	for _, waitCh := range waiters {
+		close(waitCh)
+	}
 }
 
 // stop closes the closeCh to signal other routines to exit
 // It SHOULD NOT be called under `clientLock`.
-func (k *kafkaSaramaProducer) stop() {
+func (k *kafkaSaramaProducer) stop(ctx context.Context) {
 	if atomic.SwapInt32(&k.closing, kafkaProducerClosing) == kafkaProducerClosing {
 		return
 	}
 	log.Info("kafka producer closing...", zap.String("namespace", k.id.Namespace),
-		zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
+		zap.String("changefeed", k.id.ID), zap.Any("role", k.role), zap.Error(ctx.Err()))
 	close(k.closeCh)
 }
 
-// Close closes the sync and async clients.
-func (k *kafkaSaramaProducer) Close() error {
+// closeWithContext runs closer in the background and waits for either it to finish or
+// ctx to be cancelled, whichever happens first. On cancellation closer is left running
+// to release its resources, but Close no longer blocks the caller on it.
+func closeWithContext(ctx context.Context, closer func() error, name string, logFields ...zap.Field) error {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- closer() }()
+
+	select {
+	case <-ctx.Done():
+		log.Warn("context cancelled before "+name+" finished closing",
+			append(logFields, zap.Duration("duration", time.Since(start)))...)
+		return ctx.Err()
+	case err := <-done:
+		if err != nil {
+			log.Error("close "+name+" with error", append(logFields,
+				zap.Error(err), zap.Duration("duration", time.Since(start)))...)
+		} else {
+			log.Info(name+" closed", append(logFields, zap.Duration("duration", time.Since(start)))...)
+		}
+		return err
+	}
+}
+
+// Close closes the sync and async clients. Close is context-aware: if ctx is
+// cancelled while a shutdown step is still in flight (e.g. the owner aborting
+// changefeed teardown), Close returns promptly instead of blocking for the full
+// sarama client-close timeout, leaving the in-flight step to finish in the background.
+func (k *kafkaSaramaProducer) Close(ctx context.Context) error {
 	log.Info("stop the kafka producer", zap.String("namespace", k.id.Namespace),
 		zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
-	k.stop()
+	k.stop(ctx)
 
 	k.clientLock.Lock()
 	defer k.clientLock.Unlock()
@@ -202,61 +480,32 @@ func (k *kafkaSaramaProducer) Close() error {
 	}
 	k.producersReleased = true
 
+	logFields := []zap.Field{
+		zap.String("namespace", k.id.Namespace),
+		zap.String("changefeed", k.id.ID), zap.Any("role", k.role),
+	}
+
 	// `client` is mainly used by `asyncProducer` to fetch metadata and other related
 	// operations. When we close the `kafkaSaramaProducer`, TiCDC no need to make sure
 	// that buffered messages flushed.
 	// Consider the situation that the broker does not respond, If the client is not
 	// closed, `asyncProducer.Close()` would waste a mount of time to try flush all messages.
 	// To prevent the scenario mentioned above, close client first.
-	start := time.Now()
-	if err := k.client.Close(); err != nil {
-		log.Error("close sarama client with error", zap.Error(err),
-			zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
-	} else {
-		log.Info("sarama client closed", zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
+	if err := closeWithContext(ctx, k.client.Close, "sarama client", logFields...); err != nil && ctx.Err() != nil {
+		return err
 	}
 
-	start = time.Now()
-	err := k.asyncProducer.Close()
-	if err != nil {
-		log.Error("close async client with error", zap.Error(err),
-			zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID),
-			zap.Any("role", k.role))
-	} else {
-		log.Info("async client closed", zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
+	if err := closeWithContext(ctx, k.asyncProducer.Close, "async client", logFields...); err != nil && ctx.Err() != nil {
+		return err
 	}
-	start = time.Now()
-	err = k.syncProducer.Close()
-	if err != nil {
-		log.Error("close sync client with error", zap.Error(err),
-			zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
-	} else {
-		log.Info("sync client closed", zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
+
+	if err := closeWithContext(ctx, k.syncProducer.Close, "sync client", logFields...); err != nil && ctx.Err() != nil {
+		return err
 	}
 
 	// adminClient should be closed last, since `metricsMonitor` would use it when `Cleanup`.
-	start = time.Now()
-	if err := k.admin.Close(); err != nil {
-		log.Warn("close kafka cluster admin with error", zap.Error(err),
-			zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
-	} else {
-		log.Info("kafka cluster admin closed", zap.Duration("duration", time.Since(start)),
-			zap.String("namespace", k.id.Namespace),
-			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
+	if err := closeWithContext(ctx, k.admin.Close, "kafka cluster admin", logFields...); err != nil && ctx.Err() != nil {
+		return err
 	}
 
 	return nil
@@ -267,7 +516,7 @@ func (k *kafkaSaramaProducer) run(ctx context.Context) error {
 		log.Info("stop the kafka producer",
 			zap.String("namespace", k.id.Namespace),
 			zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
-		k.stop()
+		k.stop(ctx)
 	}()
 
 	for {
@@ -282,6 +531,9 @@ func (k *kafkaSaramaProducer) run(ctx context.Context) error {
 				zap.String("namespace", k.id.Namespace),
 				zap.String("changefeed", k.id.ID), zap.Any("role", k.role))
 			return err
+		case err := <-k.dlqErrCh:
+			k.setHealthiness(false)
+			return cerror.WrapError(cerror.ErrKafkaSendMessage, err)
 		case ack = <-k.asyncProducer.Successes():
 		case err := <-k.asyncProducer.Errors():
 			// We should not wrap a nil pointer if the pointer is of a subtype of `error`
@@ -290,16 +542,26 @@ func (k *kafkaSaramaProducer) run(ctx context.Context) error {
 			if err == nil {
 				return nil
 			}
-			return cerror.WrapError(cerror.ErrKafkaAsyncSendMessage, err)
+			perr, ok := err.(*sarama.ProducerError)
+			if !ok {
+				k.setHealthiness(false)
+				return cerror.WrapError(cerror.ErrKafkaAsyncSendMessage, err)
+			}
+			// A retriable error is re-enqueued and a terminal one is routed to the
+			// dead-letter topic by handleProducerError; only a failure to do either
+			// (e.g. the dead-letter publish itself could not be completed) tears the
+			// changefeed down here, turning poison-pill messages into observable
+			// events instead of outages.
+			if err := k.handleProducerError(ctx, perr); err != nil {
+				k.setHealthiness(false)
+				return cerror.WrapError(cerror.ErrKafkaAsyncSendMessage, err)
+			}
 		}
 		if ack != nil {
-			k.mu.Lock()
-			k.mu.inflight--
-			if k.mu.inflight == 0 && k.mu.flushDone != nil {
-				k.mu.flushDone <- struct{}{}
-				k.mu.flushDone = nil
-			}
-			k.mu.Unlock()
+			atomic.AddInt64(&k.acked, 1)
+			k.wakeFlushWaiters()
+			k.setLiveness(true)
+			k.setHealthiness(true)
 		}
 	}
 }
@@ -334,16 +596,21 @@ func NewKafkaSaramaProducer(
 		return nil, cerror.WrapError(cerror.ErrKafkaNewSaramaProducer, err)
 	}
 
-	runSaramaMetricsMonitor(ctx, client.MetricRegistry(), changefeedID, role, admin)
+	runProducerMetricsMonitor(ctx, client.MetricRegistry(), changefeedID, role, admin)
 
 	k := &kafkaSaramaProducer{
 		admin:         admin,
 		client:        client,
 		asyncProducer: asyncProducer,
 		syncProducer:  syncProducer,
+		partitions:    make(map[int32]chan *sarama.ProducerMessage),
 		closeCh:       make(chan struct{}),
 		failpointCh:   make(chan error, 1),
+		dlqErrCh:      make(chan error, 1),
 		closing:       kafkaProducerRunning,
+		options:       options,
+		eosEnabled:    options.EnableExactlyOnce,
+		runCtx:        ctx,
 
 		id:   changefeedID,
 		role: role,
@@ -412,7 +679,7 @@ func AdjustOptions(
 			return errors.Trace(err)
 		}
 
-		return nil
+		return negotiateBrokerCapabilities(admin, options, topic, info, exists)
 	}
 
 	brokerMessageMaxBytesStr, err := admin.GetBrokerConfig(kafka.BrokerMessageMaxBytesConfigName)
@@ -443,6 +710,70 @@ func AdjustOptions(
 		log.Warn("partition-num is not set, use the default partition count",
 			zap.String("topic", topic), zap.Int32("partitions", options.PartitionNum))
 	}
+	return negotiateBrokerCapabilities(admin, options, topic, info, exists)
+}
+
+// negotiateBrokerCapabilities extends the `max.message.bytes`/`min.insync.replicas`
+// reconciliation above with the rest of the broker/topic capability surface that can
+// otherwise only be discovered the hard way, as a runtime `ErrUnsupportedVersion` or
+// `ErrInvalidTimestamp` on the first `AsyncSendMessage`: the highest sarama protocol
+// version the broker's ApiVersions response supports, whether the requested
+// compression codec is actually usable, and whether producing to an existing compacted
+// topic without a stable message key would silently corrupt that topic's log
+// compaction. The cleanup policy is only checked for a topic that already exists; a
+// topic that is about to be auto-created is not checked.
+func negotiateBrokerCapabilities(
+	admin kafka.ClusterAdminClient,
+	options *kafka.Options,
+	topic string,
+	info kafka.TopicDetail,
+	exists bool,
+) error {
+	version, err := admin.GetBrokerVersion()
+	if err != nil {
+		log.Warn("TiCDC cannot probe the broker's supported API versions, "+
+			"keep using the configured kafka protocol version", zap.Error(err))
+	} else if options.Version == "" {
+		options.Version = version.String()
+	} else if pinned, parseErr := sarama.ParseKafkaVersion(options.Version); parseErr != nil {
+		log.Warn("TiCDC cannot parse the configured kafka protocol version, "+
+			"keep using it as-is", zap.String("configured-version", options.Version), zap.Error(parseErr))
+	} else if version.IsAtLeast(pinned) {
+		// The broker supports at least the configured version, so it is safe to raise
+		// to the broker's (higher or equal) reported version. A broker older than the
+		// configured version is left alone: silently lowering a user-pinned version
+		// could mask a genuine incompatibility instead of surfacing it.
+		options.Version = version.String()
+	}
+
+	if options.Compression == "zstd" && err == nil && !version.IsAtLeast(sarama.V2_1_0_0) {
+		log.Warn("broker does not support zstd compression (requires Kafka >= 2.1), "+
+			"downgrading to no compression", zap.String("broker-version", version.String()))
+		options.Compression = "none"
+	}
+
+	var retentionMs, cleanupPolicy, timestampType string
+	if exists {
+		// retention.ms/cleanup.policy/message.timestamp.type are topic-only settings
+		// with no broker-wide equivalent worth falling back to; unlike
+		// getTopicConfig's other callers, a missing entry here should simply be
+		// treated as absent rather than passed through to GetBrokerConfig under the
+		// topic's config name, which isn't a valid broker config name.
+		retentionMs = info.ConfigEntries[kafka.TopicRetentionMsConfigName]
+		cleanupPolicy = info.ConfigEntries[kafka.TopicCleanupPolicyConfigName]
+		timestampType = info.ConfigEntries[kafka.TopicMessageTimestampTypeConfigName]
+		if cleanupPolicy == "compact" && !options.HasStableMessageKey() {
+			return cerror.ErrKafkaInvalidConfig.GenWithStack(
+				"topic %s is compacted (`cleanup.policy=compact`) but TiCDC is not configured with "+
+					"a stable message key strategy; refusing to produce, since log compaction "+
+					"would silently drop rows that share a key", topic)
+		}
+	}
+
+	log.Info("kafka broker/topic capability negotiation complete",
+		zap.String("topic", topic), zap.String("kafka-version", options.Version),
+		zap.String("compression", options.Compression), zap.String("message.timestamp.type", timestampType),
+		zap.String("retention.ms", retentionMs), zap.String("cleanup.policy", cleanupPolicy))
 	return nil
 }
 
@@ -0,0 +1,468 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/cdc/sink/codec/common"
+	"github.com/pingcap/tiflow/pkg/sink/kafka"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAsyncProducer is a minimal stand-in for kafka.AsyncProducer, draining whatever
+// lands on Input() straight into Successes() so tests can observe acks without a real
+// broker. It also implements transactionalProducer, so it can double as the
+// idempotent/transactional producer tests need to exercise the EOS state machine.
+type fakeAsyncProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	closed    chan struct{}
+	// delivered mirrors every message forwarded to successes, so tests can see which
+	// messages were delivered even though the producer's own `run` loop consumes
+	// Successes().
+	delivered chan *sarama.ProducerMessage
+
+	txnMu                                         sync.Mutex
+	beginTxnCount, commitTxnCount, abortTxnCount int
+}
+
+func newFakeAsyncProducer() *fakeAsyncProducer {
+	p := &fakeAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage, 16),
+		successes: make(chan *sarama.ProducerMessage, 16),
+		errors:    make(chan *sarama.ProducerError, 16),
+		closed:    make(chan struct{}),
+		delivered: make(chan *sarama.ProducerMessage, 16),
+	}
+	go func() {
+		for {
+			select {
+			case <-p.closed:
+				return
+			case msg := <-p.input:
+				p.successes <- msg
+				select {
+				case p.delivered <- msg:
+				default:
+				}
+			}
+		}
+	}()
+	return p
+}
+
+func (p *fakeAsyncProducer) Input() chan *sarama.ProducerMessage        { return p.input }
+func (p *fakeAsyncProducer) Successes() <-chan *sarama.ProducerMessage  { return p.successes }
+func (p *fakeAsyncProducer) Errors() <-chan *sarama.ProducerError       { return p.errors }
+func (p *fakeAsyncProducer) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
+
+func (p *fakeAsyncProducer) BeginTxn() error {
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	p.beginTxnCount++
+	return nil
+}
+
+func (p *fakeAsyncProducer) CommitTxn() error {
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	p.commitTxnCount++
+	return nil
+}
+
+func (p *fakeAsyncProducer) AbortTxn() error {
+	p.txnMu.Lock()
+	defer p.txnMu.Unlock()
+	p.abortTxnCount++
+	return nil
+}
+
+// newTestProducer builds a kafkaSaramaProducer wired to a fakeAsyncProducer, without
+// going through NewKafkaSaramaProducer (which depends on the pkg/sink/kafka.Client /
+// ClusterAdminClient wiring this package doesn't own).
+func newTestProducer(t *testing.T, runCtx context.Context) (*kafkaSaramaProducer, *fakeAsyncProducer) {
+	t.Helper()
+	return newTestProducerWithOptions(t, runCtx, false)
+}
+
+// newTestProducerWithOptions is like newTestProducer, but lets the EOS path be
+// exercised by turning on eosEnabled, backed by a producer that also satisfies
+// transactionalProducer.
+func newTestProducerWithOptions(
+	t *testing.T, runCtx context.Context, eosEnabled bool,
+) (*kafkaSaramaProducer, *fakeAsyncProducer) {
+	t.Helper()
+	ap := newFakeAsyncProducer()
+	k := &kafkaSaramaProducer{
+		asyncProducer: ap,
+		partitions:    make(map[int32]chan *sarama.ProducerMessage),
+		closeCh:       make(chan struct{}),
+		failpointCh:   make(chan error, 1),
+		dlqErrCh:      make(chan error, 1),
+		closing:       kafkaProducerRunning,
+		runCtx:        runCtx,
+		eosEnabled:    eosEnabled,
+		id:            model.ChangeFeedID{Namespace: "default", ID: "test"},
+	}
+	go func() {
+		_ = k.run(runCtx)
+	}()
+	t.Cleanup(func() { _ = ap.Close() })
+	return k, ap
+}
+
+// TestPartitionDispatcherOutlivesPerCallContext guards against the dispatcher goroutine
+// being bound to the context of whichever AsyncSendMessage call happens to create a
+// partition's queue: that context is typically scoped to a single call and is cancelled
+// long before the producer itself is done, which would otherwise leave the cached queue
+// undrained and hang every future Flush on that partition.
+func TestPartitionDispatcherOutlivesPerCallContext(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducer(t, runCtx)
+
+	firstCallCtx, cancelFirstCall := context.WithCancel(context.Background())
+	require.NoError(t, k.AsyncSendMessage(firstCallCtx, "topic", 0, &common.Message{}))
+	// The call that created partition 0's queue/dispatcher returns, and its own ctx
+	// is cancelled immediately afterwards, as a real caller's would be.
+	cancelFirstCall()
+
+	require.NoError(t, k.Flush(context.Background()))
+
+	// A later call against the same partition, with an unrelated context, must still
+	// be drained by the still-running dispatcher.
+	require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", 0, &common.Message{}))
+	require.NoError(t, k.Flush(context.Background()))
+}
+
+// TestConcurrentAsyncSendMessageAndFlush exercises many goroutines submitting to
+// different partitions concurrently with Flush, the scenario the submitted/acked
+// cursor redesign exists for.
+func TestConcurrentAsyncSendMessageAndFlush(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducer(t, runCtx)
+
+	const goroutines = 8
+	const perGoroutine = 50
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(partition int32) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", partition, &common.Message{}))
+			}
+		}(int32(g))
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, k.Flush(ctx))
+}
+
+// TestFlushDoesNotMissFinalAck guards against the lost-wakeup race in awaitAcked: if
+// the final ack lands between checking the acked cursor and registering a waiter,
+// wakeFlushWaiters could run against an as-yet-empty waiter list and Flush would then
+// register a waiter that never gets closed. Repeating many tight send-then-flush
+// cycles gives the race many chances to reproduce if it regresses; each cycle has its
+// own bounded timeout so a hang fails the test instead of hanging the suite.
+func TestFlushDoesNotMissFinalAck(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducer(t, runCtx)
+
+	for i := 0; i < 500; i++ {
+		require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", 0, &common.Message{}))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := k.Flush(ctx)
+		cancel()
+		require.NoError(t, err, "Flush hung on iteration %d", i)
+	}
+}
+
+// TestEnsureTxnOpenAndFlushCommits exercises the EOS state machine: the first message
+// of a resolved-ts window lazily opens a transaction, later messages in the same window
+// reuse it, and Flush commits it once every message has been acked.
+func TestEnsureTxnOpenAndFlushCommits(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, ap := newTestProducerWithOptions(t, runCtx, true)
+
+	require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", 0, &common.Message{}))
+	require.True(t, k.txn.open)
+	require.Equal(t, 1, ap.beginTxnCount)
+
+	// A second message in the same window must not open a second transaction.
+	require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", 0, &common.Message{}))
+	require.Equal(t, 1, ap.beginTxnCount)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, k.Flush(ctx))
+	require.False(t, k.txn.open)
+	require.Equal(t, 1, ap.commitTxnCount)
+
+	// The window after Flush lazily opens a fresh transaction of its own.
+	require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", 0, &common.Message{}))
+	require.Equal(t, 2, ap.beginTxnCount)
+}
+
+// TestBeginTxnRejectsNestedWindow guards against a caller starting a new resolved-ts
+// window before the previous one has been committed or aborted.
+func TestBeginTxnRejectsNestedWindow(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducerWithOptions(t, runCtx, true)
+
+	require.NoError(t, k.BeginTxn(1))
+	require.Error(t, k.BeginTxn(2))
+}
+
+// TestEnsureTxnOpenIsRaceFree drives many concurrent AsyncSendMessage calls against a
+// producer with no transaction open yet, the scenario chunk0-1's concurrency redesign
+// enables: only one of them may actually open the transaction, and none may see the
+// "already open" condition as an error, since that would fail an otherwise legitimate
+// message.
+func TestEnsureTxnOpenIsRaceFree(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, ap := newTestProducerWithOptions(t, runCtx, true)
+
+	const goroutines = 32
+	var wg sync.WaitGroup
+	errs := make([]error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = k.AsyncSendMessage(context.Background(), "topic", int32(i%4), &common.Message{})
+		}(g)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, ap.beginTxnCount, "exactly one goroutine should have opened the transaction")
+	require.True(t, k.txn.open)
+}
+
+// TestHealthinessRecoversOnAck guards against the healthiness channel only ever
+// emitting `false`: after an ack is observed, EnableHealthinessChannel's contract
+// ("`true` otherwise") must actually be honored.
+func TestHealthinessRecoversOnAck(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducer(t, runCtx)
+
+	healthinessCh := k.EnableHealthinessChannel(true)
+	k.setHealthiness(false)
+	select {
+	case healthy := <-healthinessCh:
+		require.False(t, healthy)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for initial false healthiness")
+	}
+
+	require.NoError(t, k.AsyncSendMessage(context.Background(), "topic", 0, &common.Message{}))
+	select {
+	case healthy := <-healthinessCh:
+		require.True(t, healthy)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for healthiness to recover to true after an ack")
+	}
+}
+
+// TestLivenessSilenceWindowConfigurable guards against the liveness silence window
+// being a hard-coded constant: a producer configured with a short window must report
+// liveness false once that window elapses without an ack.
+func TestLivenessSilenceWindowConfigurable(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducer(t, runCtx)
+	k.options = &kafka.Options{LivenessSilenceWindow: 50 * time.Millisecond}
+
+	livenessCh := k.EnableLivenessChannel(true)
+	select {
+	case live := <-livenessCh:
+		require.False(t, live, "liveness must go false once the configured window elapses")
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for liveness to go false")
+	}
+}
+
+// TestHandleProducerErrorRetriesThenDeadLetters drives handleProducerError through a
+// retriable error, confirming it is re-enqueued rather than dead-lettered, and then
+// through a terminal error, confirming it reaches the dead-letter topic without
+// blocking the caller (the scenario that used to risk deadlocking `run`).
+func TestHandleProducerErrorRetriesThenDeadLetters(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, ap := newTestProducer(t, runCtx)
+	k.options = &kafka.Options{}
+
+	retriable := &sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{Topic: "topic", Partition: 0},
+		Err: sarama.ErrRequestTimedOut,
+	}
+	done := make(chan error, 1)
+	go func() { done <- k.handleProducerError(context.Background(), retriable) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("handleProducerError blocked on a retriable error")
+	}
+
+	terminal := &sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{Topic: "topic", Partition: 0},
+		Err: sarama.ErrInvalidMessage,
+	}
+	go func() { done <- k.handleProducerError(context.Background(), terminal) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("handleProducerError blocked on a terminal error")
+	}
+
+	select {
+	case dlqMsg := <-ap.delivered:
+		require.Equal(t, "topic"+dlqTopicSuffix, dlqMsg.Topic)
+		require.True(t, isDeadLetterMessage(dlqMsg))
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the message to reach its dead-letter topic")
+	}
+}
+
+// TestHandleProducerErrorDropsRepeatedDeadLetterFailure guards against a second
+// terminal failure on an already-DLQ'd message chaining into `foo.DLQ.DLQ`: it must be
+// dropped and reported as an error instead of re-routed.
+func TestHandleProducerErrorDropsRepeatedDeadLetterFailure(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, ap := newTestProducer(t, runCtx)
+	k.options = &kafka.Options{}
+
+	// Simulate the original message's submission, which was already counted against
+	// k.submitted long before its dead-letter publish reached this terminal failure.
+	atomic.StoreInt64(&k.submitted, 1)
+
+	alreadyDeadLettered := &sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{
+			Topic:     "topic" + dlqTopicSuffix,
+			Partition: 0,
+			Headers: []sarama.RecordHeader{
+				{Key: []byte(dlqOriginalTopicHeaderKey), Value: []byte("topic")},
+			},
+		},
+		Err: sarama.ErrInvalidMessage,
+	}
+	require.Error(t, k.handleProducerError(context.Background(), alreadyDeadLettered))
+
+	select {
+	case msg := <-ap.delivered:
+		t.Fatalf("an already-dead-lettered message must not be re-routed, got %q", msg.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A permanently dropped message must still resolve its slot in the submitted/acked
+	// cursor: otherwise Flush would block on it until ctx cancellation, turning the
+	// poison-pill the DLQ was meant to route around into exactly the stall it was meant
+	// to prevent.
+	require.Equal(t, int64(1), atomic.LoadInt64(&k.acked))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, k.Flush(ctx))
+}
+
+// TestMaxRetriesDefaultsWhenUnset guards against Options.MaxRetries being left at its
+// zero value silently disabling retry for every transient error.
+func TestMaxRetriesDefaultsWhenUnset(t *testing.T) {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	k, _ := newTestProducer(t, runCtx)
+	k.options = &kafka.Options{}
+
+	require.Equal(t, defaultMaxRetries, k.maxRetries())
+
+	k.options.MaxRetries = 7
+	require.Equal(t, 7, k.maxRetries())
+}
+
+// fakeClusterAdmin implements just enough of kafka.ClusterAdminClient for
+// negotiateBrokerCapabilities.
+type fakeClusterAdmin struct {
+	kafka.ClusterAdminClient
+	brokerVersion sarama.KafkaVersion
+}
+
+func (a *fakeClusterAdmin) GetBrokerVersion() (sarama.KafkaVersion, error) {
+	return a.brokerVersion, nil
+}
+
+// TestNegotiateBrokerCapabilitiesNeverLowersPinnedVersion guards against a
+// user-pinned protocol version being silently downgraded to whatever the broker
+// reports, while still allowing it to be raised when the broker supports more.
+func TestNegotiateBrokerCapabilitiesNeverLowersPinnedVersion(t *testing.T) {
+	admin := &fakeClusterAdmin{brokerVersion: sarama.V2_1_0_0}
+
+	pinnedHigherThanBroker := &kafka.Options{Version: sarama.V2_6_0_0.String()}
+	require.NoError(t, negotiateBrokerCapabilities(admin, pinnedHigherThanBroker, "topic", kafka.TopicDetail{}, false))
+	require.Equal(t, sarama.V2_6_0_0.String(), pinnedHigherThanBroker.Version,
+		"a pinned version newer than the broker's must not be lowered")
+
+	pinnedLowerThanBroker := &kafka.Options{Version: sarama.V0_11_0_0.String()}
+	require.NoError(t, negotiateBrokerCapabilities(admin, pinnedLowerThanBroker, "topic", kafka.TopicDetail{}, false))
+	require.Equal(t, sarama.V2_1_0_0.String(), pinnedLowerThanBroker.Version,
+		"a pinned version older than the broker's may be raised toward the broker's")
+
+	unpinned := &kafka.Options{}
+	require.NoError(t, negotiateBrokerCapabilities(admin, unpinned, "topic", kafka.TopicDetail{}, false))
+	require.Equal(t, sarama.V2_1_0_0.String(), unpinned.Version)
+}
+
+// TestNegotiateBrokerCapabilitiesSkipsBrokerFallbackForTopicOnlyConfigs guards
+// against retention.ms/cleanup.policy/message.timestamp.type falling back to
+// GetBrokerConfig under the topic's config name, which isn't a valid broker config
+// name and would previously swallow the resulting error and silently blank the value.
+func TestNegotiateBrokerCapabilitiesSkipsBrokerFallbackForTopicOnlyConfigs(t *testing.T) {
+	admin := &fakeClusterAdmin{brokerVersion: sarama.V2_1_0_0}
+	info := kafka.TopicDetail{ConfigEntries: map[string]string{
+		kafka.TopicCleanupPolicyConfigName: "delete",
+	}}
+	options := &kafka.Options{}
+
+	// Must not panic or error trying to fetch retention.ms/message.timestamp.type
+	// from the broker just because the topic doesn't set them.
+	require.NoError(t, negotiateBrokerCapabilities(admin, options, "topic", info, true))
+}
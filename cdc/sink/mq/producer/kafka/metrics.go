@@ -0,0 +1,126 @@
+// Copyright 2020 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/sink/kafka"
+	"github.com/pingcap/tiflow/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	go_metrics "github.com/rcrowley/go-metrics"
+	"go.uber.org/zap"
+)
+
+// metricsMonitorInterval is how often runProducerMetricsMonitor refreshes the broker
+// and client-library metrics it reports.
+const metricsMonitorInterval = 15 * time.Second
+
+// saramaMeterNames are the subset of sarama's go-metrics names that are exposed under
+// the shared producerMetricGauge names below. Every backend that wants dashboards built
+// against the sarama producer to keep working unchanged reports under the same label,
+// so the map key doubles as the exported metric name.
+var saramaMeterNames = map[string]string{
+	"batch-size":            "batch-size",
+	"record-send-rate":      "record-send-rate",
+	"records-per-request":   "records-per-request",
+	"compression-ratio":     "compression-ratio",
+	"request-latency-in-ms": "request-latency-in-ms",
+	"incoming-byte-rate":    "incoming-byte-rate",
+	"outgoing-byte-rate":    "outgoing-byte-rate",
+}
+
+// producerMetricGauge reports, under a name shared by every Producer backend, the
+// latest value go-metrics observed for that name. Backends that have no equivalent
+// (confluent-kafka-go reports through its own stats callback, not go-metrics) simply
+// never set it, so the gauge is absent from scrapes rather than reported as zero.
+var producerMetricGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "ticdc",
+		Subsystem: "sink",
+		Name:      "kafka_producer_metric",
+		Help:      "Kafka producer client metrics, labelled by the underlying metric name.",
+	}, []string{"namespace", "changefeed", "metric"})
+
+func init() {
+	prometheus.MustRegister(producerMetricGauge)
+}
+
+// runProducerMetricsMonitor periodically reports producer-facing metrics under names
+// shared by every Producer backend. registry is the client-library-specific metrics
+// source (a go-metrics Registry for the sarama backend, nil for backends that report
+// through other means) and is only consulted opportunistically. With a nil registry,
+// as the confluent-kafka-go backend passes, no client metrics are reported at all, so
+// dashboards built against the sarama backend show nothing for that backend.
+func runProducerMetricsMonitor(
+	ctx context.Context,
+	registry go_metrics.Registry,
+	changefeedID model.ChangeFeedID,
+	role util.Role,
+	admin kafka.ClusterAdminClient,
+) {
+	go func() {
+		ticker := time.NewTicker(metricsMonitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reportSaramaMetrics(registry, changefeedID)
+
+				brokers, err := admin.GetAllTopicsMeta()
+				if err != nil {
+					log.Warn("kafka producer metrics monitor failed to refresh broker metadata",
+						zap.String("namespace", changefeedID.Namespace),
+						zap.String("changefeed", changefeedID.ID), zap.Any("role", role), zap.Error(err))
+					continue
+				}
+				log.Debug("kafka producer metrics monitor tick",
+					zap.String("namespace", changefeedID.Namespace),
+					zap.String("changefeed", changefeedID.ID), zap.Any("role", role),
+					zap.Int("topics", len(brokers)), zap.Bool("has-registry", registry != nil))
+			}
+		}
+	}()
+}
+
+// reportSaramaMetrics copies the subset of registry named in saramaMeterNames onto
+// producerMetricGauge. It is a no-op when registry is nil, which is how backends
+// without a go-metrics registry of their own (confluent-kafka-go) opt out.
+func reportSaramaMetrics(registry go_metrics.Registry, changefeedID model.ChangeFeedID) {
+	if registry == nil {
+		return
+	}
+	for saramaName, exportedName := range saramaMeterNames {
+		metric := registry.Get(saramaName)
+		if metric == nil {
+			continue
+		}
+
+		var value float64
+		switch m := metric.(type) {
+		case go_metrics.Meter:
+			value = m.Snapshot().RateMean()
+		case go_metrics.Histogram:
+			value = m.Snapshot().Mean()
+		default:
+			continue
+		}
+		producerMetricGauge.WithLabelValues(changefeedID.Namespace, changefeedID.ID, exportedName).Set(value)
+	}
+}
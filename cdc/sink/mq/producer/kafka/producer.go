@@ -0,0 +1,78 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/cdc/sink/codec/common"
+	cerror "github.com/pingcap/tiflow/pkg/errors"
+	"github.com/pingcap/tiflow/pkg/sink/kafka"
+)
+
+// Producer is the interface the mq sink depends on to talk to Kafka. It is implemented
+// by kafkaSaramaProducer (backed by Shopify/sarama) and by confluentKafkaProducer
+// (backed by confluent-kafka-go/librdkafka), so that the sink layer above stays
+// agnostic to which client library is actually moving bytes.
+type Producer interface {
+	// AsyncSendMessage asynchronously sends a message to the given topic/partition.
+	// It is safe to call from multiple goroutines concurrently, including concurrently
+	// with Flush.
+	AsyncSendMessage(ctx context.Context, topic string, partition int32, message *common.Message) error
+	// SyncBroadcastMessage synchronously sends a message to every partition of topic.
+	SyncBroadcastMessage(ctx context.Context, topic string, partitionsNum int32, message *common.Message) error
+	// Flush waits for all messages submitted before this call to be acked.
+	Flush(ctx context.Context) error
+	// Close releases the resources held by the producer. Close is context-aware: it
+	// returns as soon as ctx is cancelled even if shutdown steps are still in flight.
+	Close(ctx context.Context) error
+
+	// BeginTxn opens a new Kafka transaction for the resolved-ts window starting at
+	// resolvedTs. On the sarama backend it is a no-op when `EnableExactlyOnce` is not
+	// set. The confluent-kafka-go backend forwards BeginTxn, CommitTxn and AbortTxn to
+	// librdkafka unconditionally, without checking `EnableExactlyOnce` or whether a
+	// transaction is open.
+	BeginTxn(resolvedTs model.Ts) error
+	// CommitTxn commits the currently open transaction. On the sarama backend it is a
+	// no-op when no transaction is open.
+	CommitTxn() error
+	// AbortTxn aborts the currently open transaction, discarding every message
+	// produced within it. On the sarama backend it is a no-op when no transaction is
+	// open.
+	AbortTxn() error
+}
+
+var _ Producer = (*kafkaSaramaProducer)(nil)
+
+// NewProducer creates a Producer using the backend selected by options.Backend,
+// defaulting to the sarama implementation when unset.
+func NewProducer(
+	ctx context.Context,
+	client kafka.Client,
+	admin kafka.ClusterAdminClient,
+	options *kafka.Options,
+	errCh chan error,
+	changefeedID model.ChangeFeedID,
+) (Producer, error) {
+	switch options.Backend {
+	case "", kafka.BackendSarama:
+		return NewKafkaSaramaProducer(ctx, client, admin, options, errCh, changefeedID)
+	case kafka.BackendConfluent:
+		return newConfluentKafkaProducer(ctx, admin, options, errCh, changefeedID)
+	default:
+		return nil, cerror.ErrKafkaInvalidConfig.GenWithStack(
+			"unknown kafka producer backend: %s", options.Backend)
+	}
+}